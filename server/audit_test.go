@@ -0,0 +1,47 @@
+package chserver
+
+import "testing"
+
+func TestAuditEventsBeforeWrap(t *testing.T) {
+	a, err := NewAudit("", 3)
+	if err != nil {
+		t.Fatalf("NewAudit: unexpected error: %s", err)
+	}
+	a.Record(AuditEvent{SessionID: 1})
+	a.Record(AuditEvent{SessionID: 2})
+
+	got := a.Events()
+	want := []int{1, 2}
+	if len(got) != len(want) {
+		t.Fatalf("Events() = %d events, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		if got[i].SessionID != w {
+			t.Errorf("Events()[%d].SessionID = %d, want %d", i, got[i].SessionID, w)
+		}
+	}
+}
+
+func TestAuditEventsWraparound(t *testing.T) {
+	a, err := NewAudit("", 3)
+	if err != nil {
+		t.Fatalf("NewAudit: unexpected error: %s", err)
+	}
+	//fill the ring and then overwrite its two oldest slots, so Events()
+	//must return the oldest-surviving record first despite ringNext
+	//having wrapped around to the last slot of the backing array
+	for i := 1; i <= 5; i++ {
+		a.Record(AuditEvent{SessionID: i})
+	}
+
+	got := a.Events()
+	want := []int{3, 4, 5}
+	if len(got) != len(want) {
+		t.Fatalf("Events() = %d events, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		if got[i].SessionID != w {
+			t.Errorf("Events()[%d].SessionID = %d, want %d", i, got[i].SessionID, w)
+		}
+	}
+}
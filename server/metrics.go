@@ -0,0 +1,65 @@
+package chserver
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+//metrics holds the Prometheus collectors exposed on Config.MetricsPath.
+//It's nil when MetricsPath isn't set, so every use of it is guarded by a
+//nil check.
+type metrics struct {
+	activeSessions   prometheus.Gauge
+	handshakesTotal  prometheus.Counter
+	authFailures     prometheus.Counter
+	socksOpened      prometheus.Counter
+	socksDenied      prometheus.Counter
+	handshakeLatency prometheus.Histogram
+	bytesTransferred *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		activeSessions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "chisel", Subsystem: "server", Name: "active_sessions",
+			Help: "Number of currently connected chisel SSH sessions.",
+		}),
+		handshakesTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "chisel", Subsystem: "server", Name: "handshakes_total",
+			Help: "Total number of completed SSH handshakes.",
+		}),
+		authFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "chisel", Subsystem: "server", Name: "auth_failures_total",
+			Help: "Total number of rejected password or public-key auth attempts.",
+		}),
+		socksOpened: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "chisel", Subsystem: "server", Name: "socks_connections_opened_total",
+			Help: "Total number of accepted SOCKS5 channels.",
+		}),
+		socksDenied: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "chisel", Subsystem: "server", Name: "socks_connections_denied_total",
+			Help: "Total number of rejected SOCKS5 channels (disabled server-side, or ACL denied).",
+		}),
+		handshakeLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "chisel", Subsystem: "server", Name: "handshake_duration_seconds",
+			Help:    "Time taken from websocket upgrade to an accepted SSH config.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		bytesTransferred: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "chisel", Subsystem: "server", Name: "bytes_transferred_total",
+			Help: "Bytes transferred per tunnel, labeled by user, remote and direction.",
+		}, []string{"user", "remote", "direction"}),
+	}
+}
+
+//register adds every collector in m to reg.
+func (m *metrics) register(reg *prometheus.Registry) {
+	reg.MustRegister(
+		m.activeSessions,
+		m.handshakesTotal,
+		m.authFailures,
+		m.socksOpened,
+		m.socksDenied,
+		m.handshakeLatency,
+		m.bytesTransferred,
+	)
+}
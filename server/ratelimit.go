@@ -0,0 +1,65 @@
+package chserver
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+//defaultBurst is used when a rate limit is configured without an
+//explicit burst size
+const defaultBurst = 64 * 1024
+
+//limitedConn wraps an io.ReadWriteCloser, throttling both reads and
+//writes through a shared token-bucket limiter so a single tunnel cannot
+//exceed its configured average bandwidth. Each stream gets its own
+//limiter, so a per-user limit applies to each of that user's tunnels
+//separately, not to their combined traffic.
+type limitedConn struct {
+	io.ReadWriteCloser
+	lim *rate.Limiter
+}
+
+//limitConn wraps rwc with a token-bucket limiter enforcing bytesPerSec,
+//with bursts up to burst bytes. A non-positive bytesPerSec disables
+//limiting and returns rwc unchanged.
+func limitConn(rwc io.ReadWriteCloser, bytesPerSec int64, burst int) io.ReadWriteCloser {
+	if bytesPerSec <= 0 {
+		return rwc
+	}
+	if burst <= 0 {
+		burst = defaultBurst
+	}
+	return &limitedConn{rwc, rate.NewLimiter(rate.Limit(bytesPerSec), burst)}
+}
+
+func (l *limitedConn) Read(p []byte) (int, error) {
+	n, err := l.ReadWriteCloser.Read(p)
+	if n > 0 {
+		l.wait(n)
+	}
+	return n, err
+}
+
+func (l *limitedConn) Write(p []byte) (int, error) {
+	n, err := l.ReadWriteCloser.Write(p)
+	if n > 0 {
+		l.wait(n)
+	}
+	return n, err
+}
+
+//wait consumes n tokens from the limiter, chunked to the bucket's
+//burst size since WaitN rejects requests larger than it.
+func (l *limitedConn) wait(n int) {
+	burst := l.lim.Burst()
+	for n > 0 {
+		take := n
+		if take > burst {
+			take = burst
+		}
+		l.lim.WaitN(context.Background(), take)
+		n -= take
+	}
+}
@@ -0,0 +1,189 @@
+package chserver
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/jpillora/chisel/share"
+	"golang.org/x/crypto/ssh"
+)
+
+//tcpIPForwardRequest is the payload of an SSH "tcpip-forward" or
+//"cancel-tcpip-forward" global request, as defined in RFC4254 7.1.
+type tcpIPForwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+//tcpIPForwardResponse is the payload of every successful "tcpip-forward"
+//reply, carrying the port actually bound (the server-chosen one when the
+//client asked to bind port 0).
+type tcpIPForwardResponse struct {
+	BoundPort uint32
+}
+
+//forwardedTCPPayload is the ExtraData of a "forwarded-tcpip" channel
+//the server opens back to the client for each accepted connection.
+type forwardedTCPPayload struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+//reverseListenerEntry pairs a bound listener with the SSH session that
+//requested it, so a session teardown can find and close just its own
+//listeners without touching other sessions sharing the same server.
+type reverseListenerEntry struct {
+	ln        net.Listener
+	sessionID string
+}
+
+//reverseListeners tracks the listeners opened on behalf of clients'
+//"tcpip-forward" requests, keyed by "bindhost:boundport" so a matching
+//"cancel-tcpip-forward" (or session teardown) can find and close them.
+type reverseListeners struct {
+	mu   sync.Mutex
+	byID map[string]*reverseListenerEntry
+}
+
+func newReverseListeners() *reverseListeners {
+	return &reverseListeners{byID: map[string]*reverseListenerEntry{}}
+}
+
+//closeSession closes and forgets every listener opened by the given SSH
+//session ID, so a client that disconnects without sending
+//"cancel-tcpip-forward" (crash, network drop, normal exit) doesn't leak
+//its listener and acceptReverseForward goroutine forever.
+func (rl *reverseListeners) closeSession(sessionID string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for id, e := range rl.byID {
+		if e.sessionID != sessionID {
+			continue
+		}
+		e.ln.Close()
+		delete(rl.byID, id)
+	}
+}
+
+//cancel removes and returns the listener registered under id, but only
+//if it was opened by sessionID - any other session's request to cancel
+//it is treated the same as not found, so one session can never tear
+//down another session's forward.
+func (rl *reverseListeners) cancel(id, sessionID string) (net.Listener, bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	e, ok := rl.byID[id]
+	if !ok || e.sessionID != sessionID {
+		return nil, false
+	}
+	delete(rl.byID, id)
+	return e.ln, true
+}
+
+//handleTCPIPForward services a "tcpip-forward" global request: binds a
+//listener on the requested address (subject to user.HasAccess) and,
+//for every accepted connection, opens a "forwarded-tcpip" channel back
+//to the client and pipes bytes between the two.
+func (s *Server) handleTCPIPForward(l *chshare.Logger, sshConn *ssh.ServerConn, r *ssh.Request, user *chshare.User) {
+	var req tcpIPForwardRequest
+	if err := ssh.Unmarshal(r.Payload, &req); err != nil {
+		r.Reply(false, nil)
+		return
+	}
+	addr := fmt.Sprintf("%s:%d", req.BindAddr, req.BindPort)
+	if user != nil && !user.HasAccess(addr) {
+		l.Debugf("Denied reverse-forward bind to %s", addr)
+		r.Reply(false, nil)
+		return
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		l.Debugf("Failed to bind %s: %s", addr, err)
+		r.Reply(false, nil)
+		return
+	}
+	boundPort := uint32(ln.Addr().(*net.TCPAddr).Port)
+	id := fmt.Sprintf("%s:%d", req.BindAddr, boundPort)
+	sessionID := string(sshConn.SessionID())
+	s.reverse.mu.Lock()
+	s.reverse.byID[id] = &reverseListenerEntry{ln: ln, sessionID: sessionID}
+	s.reverse.mu.Unlock()
+	l.Debugf("Reverse-forward listening on %s", id)
+	r.Reply(true, ssh.Marshal(&tcpIPForwardResponse{BoundPort: boundPort}))
+	go s.acceptReverseForward(l, sshConn, ln, req.BindAddr, boundPort, user)
+}
+
+func (s *Server) acceptReverseForward(l *chshare.Logger, sshConn *ssh.ServerConn, ln net.Listener, bindAddr string, bindPort uint32, user *chshare.User) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.forwardReverseConn(l, sshConn, conn, bindAddr, bindPort, user)
+	}
+}
+
+func (s *Server) forwardReverseConn(l *chshare.Logger, sshConn *ssh.ServerConn, conn net.Conn, bindAddr string, bindPort uint32, user *chshare.User) {
+	defer conn.Close()
+	originHost, originPort := splitHostPort(conn.RemoteAddr().String())
+	payload := forwardedTCPPayload{
+		Addr:       bindAddr,
+		Port:       bindPort,
+		OriginAddr: originHost,
+		OriginPort: originPort,
+	}
+	ch, reqs, err := sshConn.OpenChannel("forwarded-tcpip", ssh.Marshal(&payload))
+	if err != nil {
+		l.Debugf("Failed to open forwarded-tcpip channel: %s", err)
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	remote := fmt.Sprintf("%s:%d", bindAddr, bindPort)
+	bytesPerSec, burst := s.connRateLimit(user)
+	sent, received := chshare.Pipe(limitConn(conn, bytesPerSec, burst), ch)
+	l.Debugf("Reverse-forward closed (sent %d received %d)", sent, received)
+	if s.metrics != nil {
+		userName := s.userName(user)
+		s.metrics.bytesTransferred.WithLabelValues(userName, remote, "sent").Add(float64(sent))
+		s.metrics.bytesTransferred.WithLabelValues(userName, remote, "received").Add(float64(received))
+	}
+}
+
+//handleCancelTCPIPForward services a "cancel-tcpip-forward" global
+//request, closing the matching listener opened by handleTCPIPForward -
+//but only if it was opened by this same SSH session. Without that
+//check, any authenticated session could tear down another session's
+//forward just by guessing its (often well-known, fixed) bind address.
+func (s *Server) handleCancelTCPIPForward(l *chshare.Logger, sshConn *ssh.ServerConn, r *ssh.Request, user *chshare.User) {
+	var req tcpIPForwardRequest
+	if err := ssh.Unmarshal(r.Payload, &req); err != nil {
+		r.Reply(false, nil)
+		return
+	}
+	addr := fmt.Sprintf("%s:%d", req.BindAddr, req.BindPort)
+	if user != nil && !user.HasAccess(addr) {
+		l.Debugf("Denied cancel-tcpip-forward for %s", addr)
+		r.Reply(false, nil)
+		return
+	}
+	ln, ok := s.reverse.cancel(addr, string(sshConn.SessionID()))
+	if !ok {
+		r.Reply(false, nil)
+		return
+	}
+	ln.Close()
+	r.Reply(true, nil)
+}
+
+func splitHostPort(addr string) (string, uint32) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, 0
+	}
+	var port int
+	fmt.Sscanf(portStr, "%d", &port)
+	return host, uint32(port)
+}
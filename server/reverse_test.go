@@ -0,0 +1,63 @@
+package chserver
+
+import (
+	"net"
+	"testing"
+)
+
+func TestReverseListenersCancelRequiresOwningSession(t *testing.T) {
+	rl := newReverseListeners()
+	ln := &fakeListener{}
+	rl.byID["0.0.0.0:1234"] = &reverseListenerEntry{ln: ln, sessionID: "session-a"}
+
+	//a different session guessing/knowing the same bind address must not
+	//be able to tear down session-a's forward
+	if _, ok := rl.cancel("0.0.0.0:1234", "session-b"); ok {
+		t.Fatal("cancel() succeeded for a session that doesn't own the listener")
+	}
+	if _, ok := rl.byID["0.0.0.0:1234"]; !ok {
+		t.Fatal("cancel() from the wrong session removed the listener")
+	}
+	if ln.closed {
+		t.Fatal("cancel() from the wrong session closed the listener")
+	}
+
+	//the owning session can still cancel its own forward
+	got, ok := rl.cancel("0.0.0.0:1234", "session-a")
+	if !ok || got != ln {
+		t.Fatal("cancel() failed for the owning session")
+	}
+	if _, ok := rl.byID["0.0.0.0:1234"]; ok {
+		t.Fatal("cancel() left the listener registered after success")
+	}
+}
+
+func TestReverseListenersCloseSessionOnlyAffectsOwnListeners(t *testing.T) {
+	rl := newReverseListeners()
+	lnA := &fakeListener{}
+	lnB := &fakeListener{}
+	rl.byID["0.0.0.0:1111"] = &reverseListenerEntry{ln: lnA, sessionID: "session-a"}
+	rl.byID["0.0.0.0:2222"] = &reverseListenerEntry{ln: lnB, sessionID: "session-b"}
+
+	rl.closeSession("session-a")
+
+	if !lnA.closed {
+		t.Error("closeSession() did not close session-a's listener")
+	}
+	if lnB.closed {
+		t.Error("closeSession() closed session-b's listener")
+	}
+	if _, ok := rl.byID["0.0.0.0:2222"]; !ok {
+		t.Error("closeSession() removed a listener belonging to another session")
+	}
+}
+
+//fakeListener is a minimal net.Listener stub for exercising
+//reverseListeners without binding real sockets.
+type fakeListener struct {
+	closed bool
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) { return nil, nil }
+func (l *fakeListener) Close() error              { l.closed = true; return nil }
+func (l *fakeListener) Addr() net.Addr            { return nil }
@@ -15,21 +15,39 @@ import (
 	"sync/atomic"
 	"time"
 
-	socks5 "github.com/armon/go-socks5"
 	"github.com/gorilla/websocket"
 	"github.com/jpillora/chisel/share"
 	"github.com/jpillora/requestlog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/crypto/ssh"
 )
 
 type Config struct {
-	KeySeed  string
-	AuthFile string
-	Auth     string
-	Proxy    string
-	Socks5   bool
+	KeySeed             string
+	AuthFile            string
+	Auth                string
+	KeyFile             string
+	Proxy               string
+	Socks5              bool
+	SocksResolveTimeout time.Duration
+	AuditFile           string
+	AdminSecret         string
+	RateLimit           string
+	TLSCert             string
+	TLSKey              string
+	TLSDomains          []string
+	TLSClientCA         string
+	MetricsPath         string
 }
 
+//defaultSocksResolveTimeout is used when Config.SocksResolveTimeout is zero
+const defaultSocksResolveTimeout = 10 * time.Second
+
+//auditRingSize is the number of recent audit events kept in memory
+//for the admin endpoint, regardless of how much is written to AuditFile
+const auditRingSize = 256
+
 type Server struct {
 	*chshare.Logger
 	//Users is an empty map of usernames to Users
@@ -38,12 +56,22 @@ type Server struct {
 	Users    chshare.Users
 	sessions chshare.Users
 
-	fingerprint  string
-	wsCount      int
-	httpServer   *chshare.HTTPServer
-	reverseProxy *httputil.ReverseProxy
-	sshConfig    *ssh.ServerConfig
-	socksServer  *socks5.Server
+	config        *Config
+	fingerprint   string
+	wsCount       int
+	httpServer    *chshare.HTTPServer
+	reverseProxy  *httputil.ReverseProxy
+	sshConfig     *ssh.ServerConfig
+	socksEnabled  bool
+	socksResolver *serverResolver
+	socksLogger   *log.Logger
+	audit         *Audit
+	rateLimit     int64
+	reverse       *reverseListeners
+	tlsListener   net.Listener
+	tlsDone       chan error
+	metrics       *metrics
+	registry      *prometheus.Registry
 }
 
 func NewServer(config *Config) (*Server, error) {
@@ -51,9 +79,32 @@ func NewServer(config *Config) (*Server, error) {
 		Logger:     chshare.NewLogger("server"),
 		httpServer: chshare.NewHTTPServer(),
 		sessions:   chshare.Users{},
+		config:     config,
+		reverse:    newReverseListeners(),
 	}
 	s.Info = true
 
+	//setup audit log + ring buffer
+	audit, err := NewAudit(config.AuditFile, auditRingSize)
+	if err != nil {
+		return nil, err
+	}
+	s.audit = audit
+
+	//parse global rate limit, if provided
+	rateLimit, err := chshare.ParseRate(config.RateLimit)
+	if err != nil {
+		return nil, err
+	}
+	s.rateLimit = rateLimit
+
+	//setup prometheus metrics, if enabled
+	if config.MetricsPath != "" {
+		s.metrics = newMetrics()
+		s.registry = prometheus.NewRegistry()
+		s.metrics.register(s.registry)
+	}
+
 	//parse users, if provided
 	if config.AuthFile != "" {
 		users, err := chshare.ParseUsers(config.AuthFile)
@@ -73,6 +124,12 @@ func NewServer(config *Config) (*Server, error) {
 			s.Users[u.Name] = u
 		}
 	}
+	//parse authorized_keys file, if provided
+	if config.KeyFile != "" {
+		if err := s.loadAuthorizedKeys(config.KeyFile); err != nil {
+			return nil, err
+		}
+	}
 
 	//generate private key (optionally using seed)
 	key, _ := chshare.GenerateKey(config.KeySeed)
@@ -85,8 +142,9 @@ func NewServer(config *Config) (*Server, error) {
 	s.fingerprint = chshare.FingerprintKey(private.PublicKey())
 	//create ssh config
 	s.sshConfig = &ssh.ServerConfig{
-		ServerVersion:    chshare.ProtocolVersion + "-server",
-		PasswordCallback: s.authUser,
+		ServerVersion:     chshare.ProtocolVersion + "-server",
+		PasswordCallback:  s.authUser,
+		PublicKeyCallback: s.authUserKey,
 	}
 	s.sshConfig.AddHostKey(private)
 	//setup reverse proxy
@@ -106,18 +164,21 @@ func NewServer(config *Config) (*Server, error) {
 			r.Host = u.Host
 		}
 	}
-	//setup socks server (not listening on any port!)
+	//setup socks (not listening on any port!)
+	//per-connection *socks5.Server instances are built in handleSocksStream,
+	//each gated by the ACL of the user that authenticated that SSH session
 	if config.Socks5 {
-		socksConfig := &socks5.Config{}
+		timeout := config.SocksResolveTimeout
+		if timeout <= 0 {
+			timeout = defaultSocksResolveTimeout
+		}
+		s.socksResolver = &serverResolver{resolver: net.DefaultResolver, timeout: timeout}
 		if s.Debug {
-			socksConfig.Logger = log.New(os.Stdout, "[socks]", log.Ldate|log.Ltime)
+			s.socksLogger = log.New(os.Stdout, "[socks]", log.Ldate|log.Ltime)
 		} else {
-			socksConfig.Logger = log.New(ioutil.Discard, "", 0)
-		}
-		s.socksServer, err = socks5.New(socksConfig)
-		if err != nil {
-			return nil, err
+			s.socksLogger = log.New(ioutil.Discard, "", 0)
 		}
+		s.socksEnabled = true
 		s.Infof("SOCKS5 Enabled")
 	}
 	//ready!
@@ -139,21 +200,44 @@ func (s *Server) Start(host, port string) error {
 	if s.reverseProxy != nil {
 		s.Infof("Reverse proxy enabled")
 	}
-	s.Infof("Listening on %s...", port)
 
 	h := http.Handler(http.HandlerFunc(s.handleHTTP))
 	if s.Debug {
 		h = requestlog.Wrap(h)
 	}
+
+	tlsConfig, err := s.buildTLSConfig()
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		s.Infof("Listening on %s (TLS)...", port)
+		ln, done, err := listenTLS(host, port, tlsConfig, h)
+		if err != nil {
+			return err
+		}
+		s.tlsListener = ln
+		s.tlsDone = done
+		return nil
+	}
+
+	s.Infof("Listening on %s...", port)
 	return s.httpServer.GoListenAndServe(host+":"+port, h)
 }
 
 func (s *Server) Wait() error {
+	if s.tlsListener != nil {
+		return <-s.tlsDone
+	}
 	return s.httpServer.Wait()
 }
 
 func (s *Server) Close() error {
 	//this should cause an error in the open websockets
+	s.audit.Close()
+	if s.tlsListener != nil {
+		return s.tlsListener.Close()
+	}
 	return s.httpServer.Close()
 }
 
@@ -165,6 +249,17 @@ func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
 		s.handleWS(w, r)
 		return
 	}
+	//admin audit endpoint - only claims the path when actually configured,
+	//so a reverse-proxied backend serving its own /audit keeps working
+	if s.config.AdminSecret != "" && r.URL.Path == "/audit" {
+		s.handleAudit(w, r)
+		return
+	}
+	//prometheus metrics endpoint
+	if s.metrics != nil && r.URL.Path == s.config.MetricsPath {
+		promhttp.HandlerFor(s.registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+		return
+	}
 	//proxy target was provided
 	if s.reverseProxy != nil {
 		s.reverseProxy.ServeHTTP(w, r)
@@ -186,6 +281,9 @@ func (s *Server) authUser(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, er
 	u, ok := s.Users[n]
 	if !ok || u.Pass != string(pass) {
 		s.Debugf("Login failed: %s", n)
+		if s.metrics != nil {
+			s.metrics.authFailures.Inc()
+		}
 		return nil, errors.New("Invalid auth")
 	}
 	//insert session
@@ -193,6 +291,63 @@ func (s *Server) authUser(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, er
 	return nil, nil
 }
 
+//loadAuthorizedKeys parses an OpenSSH-format authorized_keys file and
+//merges the keys it finds into s.Users, keyed by the comment on each
+//key line (falling back to the key's fingerprint when no comment is
+//given). Existing AuthFile users of the same name gain key-based auth
+//in addition to their password; new names get full remote access. A
+//name may appear on more than one key line (e.g. one principal with a
+//laptop key and a phone key) - all such keys are kept, not just the
+//last one parsed.
+func (s *Server) loadAuthorizedKeys(keyFile string) error {
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return s.Errorf("Failed to read key file: %s", err)
+	}
+	if s.Users == nil {
+		s.Users = chshare.Users{}
+	}
+	for len(b) > 0 {
+		pubKey, comment, _, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			return s.Errorf("Failed to parse key file: %s", err)
+		}
+		b = rest
+		authKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pubKey)))
+		name := comment
+		if name == "" {
+			name = chshare.FingerprintKey(pubKey)
+		}
+		u, ok := s.Users[name]
+		if !ok {
+			u = &chshare.User{Name: name, Addrs: []*regexp.Regexp{chshare.UserAllowAll}}
+			s.Users[name] = u
+		}
+		u.AuthorizedKeys = append(u.AuthorizedKeys, authKey)
+	}
+	return nil
+}
+
+func (s *Server) authUserKey(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	// no auth - allow all
+	if len(s.Users) == 0 {
+		return nil, nil
+	}
+	authKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	n := c.User()
+	u, ok := s.Users[n]
+	if !ok || !u.HasAuthorizedKey(authKey) {
+		s.Debugf("Key rejected for: %s", n)
+		if s.metrics != nil {
+			s.metrics.authFailures.Inc()
+		}
+		return nil, errors.New("Invalid key")
+	}
+	//insert session
+	s.sessions[string(c.SessionID())] = u
+	return nil, nil
+}
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -200,6 +355,8 @@ var upgrader = websocket.Upgrader{
 }
 
 func (s *Server) handleWS(w http.ResponseWriter, req *http.Request) {
+	handshakeStart := time.Now()
+	peerCN := tlsPeerCN(req)
 	wsConn, err := upgrader.Upgrade(w, req, nil)
 	if err != nil {
 		s.Debugf("Failed to upgrade (%s)", err)
@@ -213,13 +370,29 @@ func (s *Server) handleWS(w http.ResponseWriter, req *http.Request) {
 		s.Debugf("Failed to handshake (%s)", err)
 		return
 	}
-	//load user
+	//load user - done ahead of the mTLS CN check below so that an early
+	//return on CN mismatch still cleans up the session authUser/authUserKey
+	//inserted during the handshake above, instead of leaking it forever
 	var user *chshare.User
 	if len(s.Users) > 0 {
 		sid := string(sshConn.SessionID())
 		user = s.sessions[sid]
 		defer delete(s.sessions, sid)
 	}
+	//in mutual-TLS mode, the verified client certificate's CN must
+	//match the authenticated SSH username - two independent identity
+	//checks are required to get in
+	if s.config.TLSClientCA != "" && peerCN != sshConn.User() {
+		s.Debugf("TLS client CN (%s) does not match SSH user (%s)", peerCN, sshConn.User())
+		sshConn.Close()
+		return
+	}
+	remoteAddr := sshConn.RemoteAddr().String()
+	//any reverse port-forwards opened by this session belong to its
+	//lifetime only - close them on disconnect so a client that never
+	//sends cancel-tcpip-forward (crash, network drop) can't leak a
+	//listener and its accept goroutine forever
+	defer s.reverse.closeSession(string(sshConn.SessionID()))
 
 	//verify configuration
 	s.Debugf("Verifying configuration")
@@ -267,37 +440,51 @@ func (s *Server) handleWS(w http.ResponseWriter, req *http.Request) {
 	//success!
 	r.Reply(true, nil)
 
+	if s.metrics != nil {
+		s.metrics.handshakesTotal.Inc()
+		s.metrics.handshakeLatency.Observe(time.Since(handshakeStart).Seconds())
+		s.metrics.activeSessions.Inc()
+		defer s.metrics.activeSessions.Dec()
+	}
+
 	//prepare connection logger
 	s.wsCount++
 	id := s.wsCount
 	l := s.Fork("session#%d", id)
 	l.Debugf("Open")
-	go s.handleSSHRequests(l, reqs)
-	go s.handleSSHChannels(l, chans)
+	go s.handleSSHRequests(l, sshConn, reqs, user)
+	go s.handleSSHChannels(l, chans, id, user, remoteAddr)
 	sshConn.Wait()
 	l.Debugf("Close")
 }
 
-func (s *Server) handleSSHRequests(l *chshare.Logger, reqs <-chan *ssh.Request) {
+func (s *Server) handleSSHRequests(l *chshare.Logger, sshConn *ssh.ServerConn, reqs <-chan *ssh.Request, user *chshare.User) {
 	for r := range reqs {
 		switch r.Type {
 		case "ping":
 			r.Reply(true, nil)
+		case "tcpip-forward":
+			s.handleTCPIPForward(l, sshConn, r, user)
+		case "cancel-tcpip-forward":
+			s.handleCancelTCPIPForward(l, sshConn, r, user)
 		default:
 			l.Debugf("Unknown request: %s", r.Type)
 		}
 	}
 }
 
-func (s *Server) handleSSHChannels(l *chshare.Logger, chans <-chan ssh.NewChannel) {
+func (s *Server) handleSSHChannels(l *chshare.Logger, chans <-chan ssh.NewChannel, sessionID int, user *chshare.User, remoteAddr string) {
 	var connCount int32
 	for ch := range chans {
 		remote := string(ch.ExtraData())
 		socks := remote == "socks"
 		//dont accept socks when --socks5 isn't enabled
-		if socks && s.socksServer == nil {
+		if socks && !s.socksEnabled {
 			l.Debugf("Denied socks request, please enable --socks5")
 			ch.Reject(ssh.Prohibited, "SOCKS5 is not enabled on the server")
+			if s.metrics != nil {
+				s.metrics.socksDenied.Inc()
+			}
 			continue
 		}
 		//accept rest
@@ -310,17 +497,65 @@ func (s *Server) handleSSHChannels(l *chshare.Logger, chans <-chan ssh.NewChanne
 		//handle stream type
 		connID := atomic.AddInt32(&connCount, 1)
 		if socks {
-			go s.handleSocksStream(l.Fork("socks#%d", connID), stream)
+			if s.metrics != nil {
+				s.metrics.socksOpened.Inc()
+			}
+			go s.handleSocksStream(l.Fork("socks#%d", connID), stream, sessionID, user, remoteAddr)
 		} else {
-			go s.handleTCPStream(l.Fork("tcp#%d", connID), stream, remote)
+			go s.handleTCPStream(l.Fork("tcp#%d", connID), stream, remote, sessionID, user, remoteAddr)
 		}
 	}
 }
 
-func (s *Server) handleSocksStream(l *chshare.Logger, src io.ReadWriteCloser) {
+//connRateLimit picks the effective bytes/sec and burst for a stream:
+//a per-user limit takes precedence over the server-wide default.
+func (s *Server) connRateLimit(user *chshare.User) (int64, int) {
+	if user != nil && user.Rate > 0 {
+		return user.Rate, user.Burst
+	}
+	return s.rateLimit, 0
+}
+
+func (s *Server) userName(user *chshare.User) string {
+	if user == nil {
+		return ""
+	}
+	return user.Name
+}
+
+func (s *Server) handleSocksStream(l *chshare.Logger, src io.ReadWriteCloser, sessionID int, user *chshare.User, remoteAddr string) {
 	l.Debugf("Openning")
-	conn := chshare.NewRWCConn(src)
-	if err := s.socksServer.ServeConn(conn); err != nil {
+	open := time.Now()
+	bytesPerSec, burst := s.connRateLimit(user)
+	counted := &byteCounter{ReadWriteCloser: limitConn(src, bytesPerSec, burst)}
+	conn := chshare.NewRWCConn(counted)
+	socksServer, session, err := s.newSocksServer(user)
+	if err == nil {
+		err = socksServer.ServeConn(conn)
+	}
+	if s.metrics != nil {
+		//unlike tcp/reverse remotes (bounded, operator-configured), a SOCKS
+		//target is an arbitrary string the client picks per-CONNECT - using
+		//it as a label would grow the metric's cardinality without bound,
+		//so it's bucketed under a single static "socks" remote instead. The
+		//audit log (Target field below) still records the real destination.
+		userName := s.userName(user)
+		s.metrics.bytesTransferred.WithLabelValues(userName, "socks", "sent").Add(float64(counted.sent))
+		s.metrics.bytesTransferred.WithLabelValues(userName, "socks", "received").Add(float64(counted.received))
+	}
+	s.audit.Record(AuditEvent{
+		Time:       time.Now(),
+		SessionID:  sessionID,
+		User:       s.userName(user),
+		RemoteAddr: remoteAddr,
+		Type:       "socks",
+		Target:     session.target,
+		Sent:       counted.sent,
+		Received:   counted.received,
+		OpenTime:   open,
+		CloseTime:  time.Now(),
+	})
+	if err != nil {
 		l.Debugf("socks error: %s", err)
 		src.Close()
 		return
@@ -328,7 +563,7 @@ func (s *Server) handleSocksStream(l *chshare.Logger, src io.ReadWriteCloser) {
 	l.Debugf("Closed")
 }
 
-func (s *Server) handleTCPStream(l *chshare.Logger, src io.ReadWriteCloser, remote string) {
+func (s *Server) handleTCPStream(l *chshare.Logger, src io.ReadWriteCloser, remote string, sessionID int, user *chshare.User, remoteAddr string) {
 	dst, err := net.Dial("tcp", remote)
 	if err != nil {
 		l.Debugf("remote: %s (%s)", remote, err)
@@ -336,6 +571,25 @@ func (s *Server) handleTCPStream(l *chshare.Logger, src io.ReadWriteCloser, remo
 		return
 	}
 	l.Debugf("Open")
-	sent, received := chshare.Pipe(src, dst)
+	open := time.Now()
+	bytesPerSec, burst := s.connRateLimit(user)
+	sent, received := chshare.Pipe(limitConn(src, bytesPerSec, burst), dst)
 	l.Debugf("Close (sent %d received %d)", sent, received)
+	if s.metrics != nil {
+		userName := s.userName(user)
+		s.metrics.bytesTransferred.WithLabelValues(userName, remote, "sent").Add(float64(sent))
+		s.metrics.bytesTransferred.WithLabelValues(userName, remote, "received").Add(float64(received))
+	}
+	s.audit.Record(AuditEvent{
+		Time:       time.Now(),
+		SessionID:  sessionID,
+		User:       s.userName(user),
+		RemoteAddr: remoteAddr,
+		Type:       "tcp",
+		Target:     remote,
+		Sent:       int64(sent),
+		Received:   int64(received),
+		OpenTime:   open,
+		CloseTime:  time.Now(),
+	})
 }
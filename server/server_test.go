@@ -0,0 +1,56 @@
+package chserver
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/jpillora/chisel/share"
+	"golang.org/x/crypto/ssh"
+)
+
+func authorizedKeyLine(t *testing.T, comment string) string {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("NewPublicKey: %s", err)
+	}
+	line := string(ssh.MarshalAuthorizedKey(sshPub))
+	//MarshalAuthorizedKey includes a trailing newline; splice the
+	//comment in before it, as a real authorized_keys file would have
+	return line[:len(line)-1] + " " + comment + "\n"
+}
+
+func TestLoadAuthorizedKeysKeepsAllKeysForSameName(t *testing.T) {
+	laptop := authorizedKeyLine(t, "alice")
+	phone := authorizedKeyLine(t, "alice")
+
+	f, err := ioutil.TempFile("", "chisel-authorized-keys-*")
+	if err != nil {
+		t.Fatalf("TempFile: %s", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(laptop + phone); err != nil {
+		t.Fatalf("WriteString: %s", err)
+	}
+	f.Close()
+
+	s := &Server{Logger: chshare.NewLogger("test"), Users: chshare.Users{}}
+	if err := s.loadAuthorizedKeys(f.Name()); err != nil {
+		t.Fatalf("loadAuthorizedKeys: unexpected error: %s", err)
+	}
+
+	u, ok := s.Users["alice"]
+	if !ok {
+		t.Fatal("loadAuthorizedKeys: expected user 'alice'")
+	}
+	if len(u.AuthorizedKeys) != 2 {
+		t.Fatalf("len(u.AuthorizedKeys) = %d, want 2 (both laptop and phone keys)", len(u.AuthorizedKeys))
+	}
+}
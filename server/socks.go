@@ -0,0 +1,73 @@
+package chserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	socks5 "github.com/armon/go-socks5"
+	"github.com/jpillora/chisel/share"
+)
+
+//serverResolver resolves SOCKS5 destination hostnames on the server
+//side using net.Resolver, bounded by a configurable timeout, rather
+//than go-socks5's default bare net.ResolveIPAddr.
+type serverResolver struct {
+	resolver *net.Resolver
+	timeout  time.Duration
+}
+
+func (r *serverResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	lookupCtx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	addrs, err := r.resolver.LookupIPAddr(lookupCtx, name)
+	if err != nil || len(addrs) == 0 {
+		return ctx, nil, fmt.Errorf("failed to resolve %s: %s", name, err)
+	}
+	return ctx, addrs[0].IP, nil
+}
+
+//userRuleSet gates SOCKS5 CONNECT/BIND requests against a specific
+//user's remote ACL, closed over per-connection so each SOCKS session
+//is checked against the user that authenticated the SSH session it
+//arrived on - the same ACL handleWS checks a plain tunnel's configured
+//remotes against. A nil user (no auth configured) allows everything. It also
+//records the requested destination so the caller can audit it once
+//ServeConn returns, since go-socks5 never hands that back directly.
+type userRuleSet struct {
+	user    *chshare.User
+	metrics *metrics
+	target  string
+}
+
+func (u *userRuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	host := req.DestAddr.FQDN
+	if host == "" {
+		host = req.DestAddr.IP.String()
+	}
+	u.target = fmt.Sprintf("%s:%d", host, req.DestAddr.Port)
+	if u.user == nil {
+		return ctx, true
+	}
+	allowed := u.user.HasAccess(u.target)
+	if !allowed && u.metrics != nil {
+		u.metrics.socksDenied.Inc()
+	}
+	return ctx, allowed
+}
+
+//newSocksServer builds a SOCKS5 server for a single connection, gated
+//by user's remote ACL and using the server's shared resolver. The
+//returned *userRuleSet can be inspected after ServeConn returns to
+//find out which destination the connection requested.
+func (s *Server) newSocksServer(user *chshare.User) (*socks5.Server, *userRuleSet, error) {
+	rules := &userRuleSet{user: user, metrics: s.metrics}
+	cfg := &socks5.Config{
+		Resolver: s.socksResolver,
+		Rules:    rules,
+		Logger:   s.socksLogger,
+	}
+	srv, err := socks5.New(cfg)
+	return srv, rules, err
+}
@@ -0,0 +1,63 @@
+package chserver
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"testing"
+
+	socks5 "github.com/armon/go-socks5"
+	"github.com/jpillora/chisel/share"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func connectReq(fqdn string, ip net.IP, port int) *socks5.Request {
+	return &socks5.Request{DestAddr: &socks5.AddrSpec{FQDN: fqdn, IP: ip, Port: port}}
+}
+
+func TestUserRuleSetAllowNilUserAllowsAll(t *testing.T) {
+	rules := &userRuleSet{}
+	_, ok := rules.Allow(context.Background(), connectReq("example.com", nil, 443))
+	if !ok {
+		t.Error("Allow() with no user configured should allow everything")
+	}
+	if rules.target != "example.com:443" {
+		t.Errorf("rules.target = %q, want %q", rules.target, "example.com:443")
+	}
+}
+
+func TestUserRuleSetAllowEnforcesACL(t *testing.T) {
+	user := &chshare.User{Addrs: []*regexp.Regexp{regexp.MustCompile(`^example\.com:443$`)}}
+	rules := &userRuleSet{user: user}
+
+	if _, ok := rules.Allow(context.Background(), connectReq("example.com", nil, 443)); !ok {
+		t.Error("Allow() should permit an address matching the user's ACL")
+	}
+	if _, ok := rules.Allow(context.Background(), connectReq("evil.example", nil, 443)); ok {
+		t.Error("Allow() should deny an address not matching the user's ACL")
+	}
+}
+
+func TestUserRuleSetAllowDeniedIncrementsMetric(t *testing.T) {
+	user := &chshare.User{Addrs: []*regexp.Regexp{regexp.MustCompile(`^example\.com:443$`)}}
+	m := newMetrics()
+	rules := &userRuleSet{user: user, metrics: m}
+
+	rules.Allow(context.Background(), connectReq("evil.example", nil, 443))
+	if got := testutil.ToFloat64(m.socksDenied); got != 1 {
+		t.Errorf("socksDenied = %v, want 1", got)
+	}
+
+	rules.Allow(context.Background(), connectReq("example.com", nil, 443))
+	if got := testutil.ToFloat64(m.socksDenied); got != 1 {
+		t.Errorf("socksDenied after an allowed request = %v, want unchanged at 1", got)
+	}
+}
+
+func TestUserRuleSetAllowFallsBackToIP(t *testing.T) {
+	rules := &userRuleSet{}
+	rules.Allow(context.Background(), connectReq("", net.ParseIP("10.0.0.1"), 22))
+	if rules.target != "10.0.0.1:22" {
+		t.Errorf("rules.target = %q, want %q", rules.target, "10.0.0.1:22")
+	}
+}
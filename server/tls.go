@@ -0,0 +1,84 @@
+package chserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+//buildTLSConfig assembles a *tls.Config from the server's TLS options,
+//or returns (nil, nil) if TLS wasn't configured at all. Two certificate
+//modes are supported (TLSDomains wins if both are set), and either may
+//be combined with mutual TLS:
+//  - TLSCert/TLSKey: a static certificate/key pair
+//  - TLSDomains: ACME autocert, fetching and renewing certs for the
+//    given domains
+//  - TLSClientCA: on top of either mode above, require and verify a
+//    client certificate signed by this CA
+func (s *Server) buildTLSConfig() (*tls.Config, error) {
+	c := s.config
+	var tlsConfig *tls.Config
+	switch {
+	case len(c.TLSDomains) > 0:
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(c.TLSDomains...),
+			Cache:      autocert.DirCache("chisel-acme-cache"),
+		}
+		tlsConfig = m.TLSConfig()
+	case c.TLSCert != "" && c.TLSKey != "":
+		cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load TLS certificate: %s", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	default:
+		if c.TLSClientCA != "" {
+			return nil, fmt.Errorf("TLSClientCA requires TLSCert/TLSKey or TLSDomains to also be set")
+		}
+		return nil, nil
+	}
+	if c.TLSClientCA != "" {
+		caBytes, err := ioutil.ReadFile(c.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read TLS client CA: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("Failed to parse TLS client CA: %s", c.TLSClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+//listenTLS binds host:port behind the given TLS config and serves h on
+//it in the background. done receives http.Serve's terminal error once
+//the listener is closed.
+func listenTLS(host, port string, tlsConfig *tls.Config, h http.Handler) (net.Listener, chan error, error) {
+	ln, err := net.Listen("tcp", host+":"+port)
+	if err != nil {
+		return nil, nil, err
+	}
+	tln := tls.NewListener(ln, tlsConfig)
+	done := make(chan error, 1)
+	go func() {
+		done <- http.Serve(tln, h)
+	}()
+	return tln, done, nil
+}
+
+//tlsPeerCN returns the verified client certificate's common name, if
+//the request arrived over mutual TLS, or "" otherwise.
+func tlsPeerCN(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.CommonName
+}
@@ -0,0 +1,42 @@
+package chserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"testing"
+)
+
+func TestTLSPeerCNNoTLS(t *testing.T) {
+	r := &http.Request{}
+	if cn := tlsPeerCN(r); cn != "" {
+		t.Errorf("tlsPeerCN() = %q, want \"\" for a non-TLS request", cn)
+	}
+}
+
+func TestTLSPeerCNReturnsVerifiedClientCN(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}
+	r := &http.Request{TLS: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}}
+	if cn := tlsPeerCN(r); cn != "alice" {
+		t.Errorf("tlsPeerCN() = %q, want %q", cn, "alice")
+	}
+}
+
+func TestBuildTLSConfigNoneConfigured(t *testing.T) {
+	s := &Server{config: &Config{}}
+	cfg, err := s.buildTLSConfig()
+	if err != nil {
+		t.Fatalf("buildTLSConfig: unexpected error: %s", err)
+	}
+	if cfg != nil {
+		t.Error("buildTLSConfig() with no TLS options set should return a nil config")
+	}
+}
+
+func TestBuildTLSConfigClientCAWithoutCertFails(t *testing.T) {
+	s := &Server{config: &Config{TLSClientCA: "/nonexistent/ca.pem"}}
+	if _, err := s.buildTLSConfig(); err == nil {
+		t.Error("buildTLSConfig() with TLSClientCA but no cert/domains should fail")
+	}
+}
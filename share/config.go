@@ -0,0 +1,45 @@
+package chshare
+
+import "encoding/json"
+
+//Config is sent from the client to the server as the payload of the
+//first SSH "config" request, once the SSH connection is established.
+type Config struct {
+	Version string
+	Remotes []*Remote
+}
+
+//Remote represents a single port-forward requested by the client.
+//Direction controls which side opens the listener: "forward" (the
+//default) is chisel's classic behaviour where the client listens
+//locally and streams accepted connections to RemoteHost:RemotePort
+//through the server; "reverse" is the ssh -R equivalent, where the
+//server listens on RemoteHost:RemotePort and streams accepted
+//connections back to LocalHost:LocalPort on the client.
+type Remote struct {
+	LocalHost  string
+	LocalPort  string
+	RemoteHost string
+	RemotePort string
+	Direction  string
+}
+
+//Reverse reports whether the server (rather than the client) should
+//own the listener for this remote.
+func (r *Remote) Reverse() bool {
+	return r.Direction == "reverse"
+}
+
+//EncodeConfig marshals a Config for transmission as an SSH request payload.
+func EncodeConfig(c *Config) ([]byte, error) {
+	return json.Marshal(c)
+}
+
+//DecodeConfig unmarshals a Config received as an SSH request payload.
+func DecodeConfig(data []byte) (*Config, error) {
+	c := &Config{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
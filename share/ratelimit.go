@@ -0,0 +1,35 @@
+package chshare
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var rateExp = regexp.MustCompile(`(?i)^(\d+(?:\.\d+)?)\s*(B|KB|MB|GB)/s$`)
+
+var rateUnits = map[string]float64{
+	"B":  1,
+	"KB": 1024,
+	"MB": 1024 * 1024,
+	"GB": 1024 * 1024 * 1024,
+}
+
+//ParseRate parses a human rate string such as "500KB/s" or "2MB/s"
+//into bytes/sec. An empty string returns 0 (unlimited).
+func ParseRate(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	m := rateExp.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid rate '%s', expected a form like '500KB/s'", s)
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(n * rateUnits[strings.ToUpper(m[2])]), nil
+}
@@ -0,0 +1,36 @@
+package chshare
+
+import "testing"
+
+func TestParseRate(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "500KB/s", want: 500 * 1024},
+		{in: "2MB/s", want: 2 * 1024 * 1024},
+		{in: "1GB/s", want: 1024 * 1024 * 1024},
+		{in: "100B/s", want: 100},
+		{in: "1.5MB/s", want: int64(1.5 * 1024 * 1024)},
+		{in: "not-a-rate", wantErr: true},
+		{in: "500KB", wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := ParseRate(c.in)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("ParseRate(%q): expected error, got nil", c.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRate(%q): unexpected error: %s", c.in, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("ParseRate(%q) = %d, want %d", c.in, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package chshare
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+//UserAllowAll is used to construct a *User which
+//has access to all remotes
+var UserAllowAll = regexp.MustCompile("")
+
+//User is a subset of defined users, each with a name, password
+//and a set of regular expressions for addresses they are
+//allowed to access. A user may also authenticate via an SSH
+//public key instead of (or as well as) a password, in which
+//case AuthorizedKeys holds the user's keys in "authorized_keys"
+//format (key type and base64 blob only, without options or
+//comment), used to match the keys the client presents - a principal commonly
+//has more than one (e.g. a laptop and a phone), so all of them
+//are kept rather than just the last one parsed.
+type User struct {
+	Addrs          []*regexp.Regexp
+	Name, Pass     string
+	AuthorizedKeys []string
+	//Rate is the average number of bytes/sec this user's tunnels are
+	//limited to, and Burst the size of the token bucket that allows
+	//short spikes above that average. A zero Rate sets no per-user
+	//limit, so the server-wide RateLimit (if any) applies instead; a
+	//zero Burst uses the default burst size.
+	Rate  int64
+	Burst int
+}
+
+//HasAuthorizedKey reports whether authKey (an "authorized_keys"-format
+//line) matches one of the user's authorized keys.
+func (u *User) HasAuthorizedKey(authKey string) bool {
+	for _, k := range u.AuthorizedKeys {
+		if k == authKey {
+			return true
+		}
+	}
+	return false
+}
+
+//HasAccess checks if the user has access to a given remote address
+func (u *User) HasAccess(addr string) bool {
+	m := false
+	for _, r := range u.Addrs {
+		if r.MatchString(addr) {
+			m = true
+			break
+		}
+	}
+	return m
+}
+
+//Users is a map of usernames to Users
+type Users map[string]*User
+
+//ParseAuth splits a "user:pass" string into its parts
+func ParseAuth(auth string) (string, string) {
+	if strings.Contains(auth, ":") {
+		pair := strings.SplitN(auth, ":", 2)
+		return pair[0], pair[1]
+	}
+	return "", ""
+}
+
+//userEntry is the richer per-user auth file shape, used when a value
+//is a JSON object rather than a bare array of address regexes.
+type userEntry struct {
+	Addrs []string `json:"addrs"`
+	Rate  string   `json:"rate"`
+	Burst int      `json:"burst"`
+}
+
+//ParseUsers parses a JSON file of the form:
+//  {
+//    "<user:pass>": ["<addr-regex>","<addr-regex>"]
+//  }
+//or, to also set a per-user rate limit:
+//  {
+//    "<user:pass>": {"addrs": ["<addr-regex>"], "rate": "500KB/s", "burst": 65536}
+//  }
+//into a map of Users, keyed by username.
+func ParseUsers(authFile string) (Users, error) {
+	b, err := ioutil.ReadFile(authFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read auth file: %s, error: %s", authFile, err)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("Invalid JSON in auth file: %s, error: %s", authFile, err)
+	}
+	users := Users{}
+	for auth, v := range raw {
+		user := &User{}
+		user.Name, user.Pass = ParseAuth(auth)
+		if user.Name == "" {
+			return nil, fmt.Errorf("Invalid user:pass entry in auth file: %s", auth)
+		}
+		var addrs []string
+		if err := json.Unmarshal(v, &addrs); err != nil {
+			var entry userEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return nil, fmt.Errorf("Invalid entry for user '%s' in auth file: %s", user.Name, err)
+			}
+			addrs = entry.Addrs
+			user.Burst = entry.Burst
+			if entry.Rate != "" {
+				rate, err := ParseRate(entry.Rate)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid rate for user '%s': %s", user.Name, err)
+				}
+				user.Rate = rate
+			}
+		}
+		for _, addr := range addrs {
+			re, err := regexp.Compile(addr)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid address regex '%s' for user '%s': %s", addr, user.Name, err)
+			}
+			user.Addrs = append(user.Addrs, re)
+		}
+		if len(user.Addrs) == 0 {
+			user.Addrs = []*regexp.Regexp{UserAllowAll}
+		}
+		users[user.Name] = user
+	}
+	return users, nil
+}
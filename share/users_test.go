@@ -0,0 +1,83 @@
+package chshare
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func writeTempAuthFile(t *testing.T, contents string) string {
+	t.Helper()
+	f, err := ioutil.TempFile("", "chisel-auth-*.json")
+	if err != nil {
+		t.Fatalf("failed to create temp auth file: %s", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatalf("failed to write temp auth file: %s", err)
+	}
+	return f.Name()
+}
+
+func TestParseUsersPlainAddrs(t *testing.T) {
+	path := writeTempAuthFile(t, `{"alice:secret": ["^example\\.com:80$"]}`)
+	defer os.Remove(path)
+
+	users, err := ParseUsers(path)
+	if err != nil {
+		t.Fatalf("ParseUsers: unexpected error: %s", err)
+	}
+	u, ok := users["alice"]
+	if !ok {
+		t.Fatalf("ParseUsers: expected user 'alice'")
+	}
+	if u.Pass != "secret" {
+		t.Errorf("u.Pass = %q, want %q", u.Pass, "secret")
+	}
+	if u.Rate != 0 || u.Burst != 0 {
+		t.Errorf("u.Rate/Burst = %d/%d, want 0/0", u.Rate, u.Burst)
+	}
+}
+
+func TestParseUsersRateBurstShape(t *testing.T) {
+	path := writeTempAuthFile(t, `{"bob:hunter2": {"addrs": ["^example\\.com:80$"], "rate": "500KB/s", "burst": 65536}}`)
+	defer os.Remove(path)
+
+	users, err := ParseUsers(path)
+	if err != nil {
+		t.Fatalf("ParseUsers: unexpected error: %s", err)
+	}
+	u, ok := users["bob"]
+	if !ok {
+		t.Fatalf("ParseUsers: expected user 'bob'")
+	}
+	if want := int64(500 * 1024); u.Rate != want {
+		t.Errorf("u.Rate = %d, want %d", u.Rate, want)
+	}
+	if u.Burst != 65536 {
+		t.Errorf("u.Burst = %d, want 65536", u.Burst)
+	}
+}
+
+func TestUserHasAuthorizedKey(t *testing.T) {
+	u := &User{AuthorizedKeys: []string{"ssh-ed25519 AAAAlaptop", "ssh-ed25519 AAAAphone"}}
+
+	if !u.HasAuthorizedKey("ssh-ed25519 AAAAlaptop") {
+		t.Error("HasAuthorizedKey: expected laptop key to match")
+	}
+	if !u.HasAuthorizedKey("ssh-ed25519 AAAAphone") {
+		t.Error("HasAuthorizedKey: expected phone key to match")
+	}
+	if u.HasAuthorizedKey("ssh-ed25519 AAAAother") {
+		t.Error("HasAuthorizedKey: expected unknown key to be rejected")
+	}
+}
+
+func TestParseUsersInvalidRate(t *testing.T) {
+	path := writeTempAuthFile(t, `{"bob:hunter2": {"addrs": ["^example\\.com:80$"], "rate": "fast"}}`)
+	defer os.Remove(path)
+
+	if _, err := ParseUsers(path); err == nil {
+		t.Fatal("ParseUsers: expected error for invalid rate, got nil")
+	}
+}